@@ -0,0 +1,271 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// errAcquireTimeout is returned by Acquire when the requested capacity did
+// not become available before the timeout elapsed.
+var errAcquireTimeout = fmt.Errorf("timed out waiting to acquire semaphore")
+
+// waiter is a single entry in a CntSema's FIFO wait queue. ready is closed
+// once n units of capacity have been reserved on the waiter's behalf.
+type waiter struct {
+	n     uint32
+	ready chan struct{}
+}
+
+// CntSema is a counting semaphore that hands out a fixed capacity in
+// arbitrary-sized chunks rather than one unit at a time. It is used to gate
+// concurrency on hot paths where callers need to reserve more than a single
+// slot at once (e.g. a batch of bytes, a batch of requests). Waiters are
+// served strictly in FIFO order, modeled on golang.org/x/sync/semaphore, so
+// that a large request cannot be starved by a stream of smaller ones.
+type CntSema struct {
+	mu      sync.Mutex
+	cap     uint32
+	cur     uint32 // currently available capacity
+	waiters list.List
+
+	totalAcquired uint64
+	totalTimeouts uint64
+
+	// metrics are only populated when the semaphore is created through
+	// NewCntSemaWithMetrics; a plain NewCntSema leaves them nil and every
+	// call site below is a no-op in that case.
+	inUseGauge   metrics.Gauge
+	waitersGauge metrics.Gauge
+	waitTimer    metrics.Timer
+	weightHist   metrics.Histogram
+}
+
+// NewCntSema creates a counting semaphore with the given capacity.
+func NewCntSema(capacity uint32) *CntSema {
+	return &CntSema{
+		cap: capacity,
+		cur: capacity,
+	}
+}
+
+// NewCntSemaWithMetrics creates a counting semaphore with the given
+// capacity, additionally registering gauges for the in-use and queued-waiter
+// counts and histograms for wait duration and requested weight under the
+// given name. This is opt-in since most semaphores are too short-lived or
+// too hot to be worth the bookkeeping; use it on the ones that gate
+// long-lived, contended resources where stalls are worth attributing.
+func NewCntSemaWithMetrics(capacity uint32, name string) *CntSema {
+	s := NewCntSema(capacity)
+	s.inUseGauge = metrics.NewRegisteredGauge(name+"/inuse", nil)
+	s.waitersGauge = metrics.NewRegisteredGauge(name+"/waiters", nil)
+	s.waitTimer = metrics.NewRegisteredTimer(name+"/wait", nil)
+	s.weightHist = metrics.NewRegisteredHistogram(name+"/weight", nil, metrics.NewExpDecaySample(1028, 0.015))
+	return s
+}
+
+// CntSemaStats is a point-in-time snapshot of a CntSema's internal state, as
+// returned by Stats.
+type CntSemaStats struct {
+	Cap           uint32
+	InUse         uint32
+	Waiters       uint32
+	TotalAcquired uint64
+	TotalTimeouts uint64
+}
+
+// Stats returns a consistent snapshot of the semaphore's state. It is cheap
+// enough to call from metrics collection or debug endpoints regardless of
+// whether the semaphore was created with NewCntSemaWithMetrics.
+func (s *CntSema) Stats() CntSemaStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return CntSemaStats{
+		Cap:           s.cap,
+		InUse:         s.cap - s.cur,
+		Waiters:       uint32(s.waiters.Len()),
+		TotalAcquired: s.totalAcquired,
+		TotalTimeouts: s.totalTimeouts,
+	}
+}
+
+// updateGaugesLocked refreshes the in-use and waiter gauges, if metrics are
+// enabled. Callers must hold s.mu.
+func (s *CntSema) updateGaugesLocked() {
+	if s.inUseGauge != nil {
+		s.inUseGauge.Update(int64(s.cap - s.cur))
+	}
+	if s.waitersGauge != nil {
+		s.waitersGauge.Update(int64(s.waiters.Len()))
+	}
+}
+
+// get returns the currently available capacity. It exists for tests.
+func (s *CntSema) get() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur
+}
+
+// AcquireCtx reserves n units of capacity, blocking until they become
+// available or ctx is cancelled. If ctx is cancelled or its deadline expires
+// before enough capacity is available, AcquireCtx returns ctx.Err(), and any
+// capacity freed up in the meantime is passed on to the next waiter in line
+// rather than left stranded.
+func (s *CntSema) AcquireCtx(ctx context.Context, n uint32) error {
+	start := time.Now()
+	if s.weightHist != nil {
+		s.weightHist.Update(int64(n))
+	}
+
+	s.mu.Lock()
+	if n > s.cap {
+		s.mu.Unlock()
+		return fmt.Errorf("requested amount %d exceeds semaphore capacity %d", n, s.cap)
+	}
+	if s.cur >= n && s.waiters.Len() == 0 {
+		s.cur -= n
+		s.totalAcquired++
+		s.updateGaugesLocked()
+		s.mu.Unlock()
+		if s.waitTimer != nil {
+			s.waitTimer.UpdateSince(start)
+		}
+		return nil
+	}
+	w := waiter{n: n, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.updateGaugesLocked()
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		err := ctx.Err()
+		s.mu.Lock()
+		select {
+		case <-w.ready:
+			// Acquired just as the context was cancelled; honor the acquire
+			// instead of leaking the reserved capacity.
+			err = nil
+			s.totalAcquired++
+		default:
+			isFront := s.waiters.Front() == elem
+			s.waiters.Remove(elem)
+			// If the cancelled waiter was blocking the line, capacity that
+			// accumulated behind it must be handed to whoever is next.
+			if isFront {
+				s.notifyWaitersLocked()
+			}
+			if err == context.DeadlineExceeded {
+				s.totalTimeouts++
+			}
+			s.updateGaugesLocked()
+		}
+		s.mu.Unlock()
+		if s.waitTimer != nil {
+			// Record the wait regardless of outcome: a stall that ends in a
+			// timeout or cancellation is exactly the kind of sample this
+			// histogram exists to surface, and dropping it would bias it
+			// toward looking healthier than the semaphore actually is.
+			s.waitTimer.UpdateSince(start)
+		}
+		return err
+	case <-w.ready:
+		s.mu.Lock()
+		s.totalAcquired++
+		s.mu.Unlock()
+		if s.waitTimer != nil {
+			s.waitTimer.UpdateSince(start)
+		}
+		return nil
+	}
+}
+
+// notifyWaitersLocked wakes as many waiters at the front of the queue as the
+// currently available capacity allows. It stops at the first waiter that
+// does not fit so that a large request is never skipped over in favor of
+// smaller ones behind it. Callers must hold s.mu.
+func (s *CntSema) notifyWaitersLocked() {
+	for {
+		front := s.waiters.Front()
+		if front == nil {
+			return
+		}
+		w := front.Value.(waiter)
+		if w.n > s.cur {
+			return
+		}
+		s.cur -= w.n
+		s.waiters.Remove(front)
+		close(w.ready)
+		s.updateGaugesLocked()
+	}
+}
+
+// Acquire reserves n units of capacity, blocking until they become available
+// or timeout elapses. It is implemented on top of AcquireCtx so there is a
+// single codepath for both the context-aware and timeout-based variants.
+func (s *CntSema) Acquire(n uint32, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.AcquireCtx(ctx, n); err != nil {
+		if err == context.DeadlineExceeded {
+			return errAcquireTimeout
+		}
+		return err
+	}
+	return nil
+}
+
+// TryAcquire reserves n units of capacity without blocking. It succeeds and
+// returns true only if n units are immediately available and no earlier
+// waiter is already queued; otherwise it returns false without sleeping,
+// queuing, or otherwise affecting the semaphore's state.
+func (s *CntSema) TryAcquire(n uint32) bool {
+	if s.weightHist != nil {
+		s.weightHist.Update(int64(n))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cur < n || s.waiters.Len() != 0 {
+		return false
+	}
+	s.cur -= n
+	s.totalAcquired++
+	s.updateGaugesLocked()
+	return true
+}
+
+// Release returns n units of capacity to the semaphore, waking as many
+// queued waiters as the newly available capacity allows.
+func (s *CntSema) Release(n uint32) {
+	s.mu.Lock()
+	s.cur += n
+	s.notifyWaitersLocked()
+	s.updateGaugesLocked()
+	s.mu.Unlock()
+}
@@ -115,6 +115,107 @@ func TestCntSemaRace(t *testing.T) {
 	}
 }
 
+// This test checks that a large acquirer queued ahead of a stream of small
+// ones is served first, instead of being starved by them.
+func TestCntSemaFIFOFairness(t *testing.T) {
+	sem := NewCntSema(10)
+
+	// Drain all capacity so subsequent acquires have to queue.
+	if err := sem.Acquire(10, time.Second); err != nil {
+		t.Fatalf("initial drain failed: %v", err)
+	}
+
+	order := make(chan string, 3)
+	go func() {
+		if err := sem.Acquire(10, time.Second); err != nil {
+			t.Errorf("large acquire failed: %v", err)
+		}
+		order <- "large"
+	}()
+
+	// Give the large acquirer time to be queued first.
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			if err := sem.Acquire(1, time.Second); err != nil {
+				t.Errorf("small acquire failed: %v", err)
+			}
+			order <- "small"
+		}()
+	}
+
+	sem.Release(10)
+
+	if got := <-order; got != "large" {
+		t.Fatalf("expected large acquirer to be served first, got %q", got)
+	}
+	sem.Release(10)
+	<-order
+	<-order
+}
+
+// This test checks that TryAcquire respects FIFO fairness: it must fail
+// while any waiter is blocked in the queue, even if raw capacity would
+// otherwise allow it to succeed.
+func TestCntSemaTryAcquire(t *testing.T) {
+	sem := NewCntSema(10)
+
+	if !sem.TryAcquire(4) {
+		t.Fatalf("TryAcquire(4) should succeed on an empty semaphore")
+	}
+	if sem.TryAcquire(11) {
+		t.Fatalf("TryAcquire(11) should fail: exceeds capacity")
+	}
+
+	blocked := make(chan struct{})
+	go func() {
+		close(blocked)
+		if err := sem.Acquire(8, time.Second); err != nil {
+			t.Errorf("blocked acquire failed: %v", err)
+		}
+	}()
+	<-blocked
+	time.Sleep(10 * time.Millisecond) // let the acquirer queue up
+
+	// 6 units are free, which would satisfy a TryAcquire(5) if fairness were
+	// ignored, but a waiter is already queued ahead of it.
+	if sem.TryAcquire(5) {
+		t.Fatalf("TryAcquire(5) should fail while an earlier waiter is queued")
+	}
+
+	sem.Release(4)
+}
+
+// This test checks that Stats reports a consistent snapshot as the
+// semaphore is used, on a semaphore created without metrics.
+func TestCntSemaStats(t *testing.T) {
+	sem := NewCntSema(10)
+
+	if stats := sem.Stats(); stats.Cap != 10 || stats.InUse != 0 || stats.Waiters != 0 {
+		t.Fatalf("unexpected initial stats: %+v", stats)
+	}
+
+	if err := sem.Acquire(4, time.Second); err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if stats := sem.Stats(); stats.InUse != 4 || stats.TotalAcquired != 1 {
+		t.Fatalf("unexpected stats after acquire: %+v", stats)
+	}
+
+	if err := sem.Acquire(10, 10*time.Millisecond); err == nil {
+		t.Fatalf("expected timeout acquiring more than available")
+	}
+	if stats := sem.Stats(); stats.TotalTimeouts != 1 {
+		t.Fatalf("unexpected stats after timeout: %+v", stats)
+	}
+
+	sem.Release(4)
+	if stats := sem.Stats(); stats.InUse != 0 {
+		t.Fatalf("unexpected stats after release: %+v", stats)
+	}
+}
+
 // property-based test
 type cntSemaTest struct {
 	capacity             uint32
@@ -149,7 +250,6 @@ func TestCntSemaQuick(t *testing.T) {
 					t.Fatalf("acquire failed: %v (count: %d)", err, sem.get())
 				}
 			}
-			fmt.Println("FUNKY acquirer done:")
 			acquireW.Done()
 		}
 
@@ -168,25 +268,31 @@ func TestCntSemaQuick(t *testing.T) {
 			}
 
 			// TODO: support interleaving acquire/release calls
+			//
+			// The running total is tracked as uint64 even though individual
+			// chunks and cst.capacity are uint32: cst.capacity can be close
+			// to math.MaxUint32, and summing two uint32 chunks that large in
+			// uint32 arithmetic can wrap around, silently sending chunks
+			// that add up to more than cst.capacity. Nothing is released
+			// until every acquirer is done, so such chunks leave some
+			// Acquire waiting until it times out and fails the test,
+			// whatever order waiters are served in.
 			sendToChannel := func(c chan uint32) {
-				for i := uint32(0); i < cst.capacity; {
-					rv := mrand.Uint32() % cst.capacity
-					if i+rv > cst.capacity {
-						rv = cst.capacity - i
+				for i := uint64(0); i < uint64(cst.capacity); {
+					rv := uint64(mrand.Uint32() % cst.capacity)
+					if i+rv > uint64(cst.capacity) {
+						rv = uint64(cst.capacity) - i
 					}
 					i += rv
-					fmt.Println("FUNKY sending:")
-					c <- rv
+					c <- uint32(rv)
 				}
 			}
 			sendToChannel(pleaseAcquire)
 			close(pleaseAcquire)
-			fmt.Println("FUNKY 1:", cst.acquirers)
 			acquireW.Wait()
 
 			sendToChannel(pleaseRelease)
 			close(pleaseRelease)
-			fmt.Println("FUNKY 2:")
 			releaseW.Wait()
 
 			c := sem.get()